@@ -1,22 +1,45 @@
 package mgo
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/globalsign/mgo/bson"
 )
 
+// changeStreamTargetType identifies the scope an aggregation pipeline
+// containing a $changeStream stage is run against, since the shape of
+// that stage (and the namespace the aggregate command is issued against)
+// differs between a single collection, a whole database and the full
+// deployment.
+type changeStreamTargetType int
+
+const (
+	collectionChangeStream changeStreamTargetType = iota
+	databaseChangeStream
+	clientChangeStream
+)
+
 type ChangeStream struct {
 	iter           *Iter
 	options        ChangeStreamOptions
 	pipeline       interface{}
 	resumeToken    *bson.Raw
 	collection     *Collection
+	database       *Database
+	targetType     changeStreamTargetType
 	readPreference *ReadPreference
 	err            error
 	m              sync.Mutex
+
+	// resumeTokenMu guards resumeToken on its own, separately from m, so
+	// that ResumeToken() can safely be called from a ChangeStreamMonitor
+	// callback invoked while m is already held by Next/NextContext/Close.
+	resumeTokenMu sync.Mutex
 }
 
 type ChangeStreamOptions struct {
@@ -28,6 +51,15 @@ type ChangeStreamOptions struct {
 	// ResumeAfter specifies the logical starting point for the new change stream.
 	ResumeAfter *bson.Raw
 
+	// StartAfter is similar to ResumeAfter, but allows resuming after an
+	// invalidate event. It takes precedence over ResumeAfter and
+	// StartAtOperationTime when more than one is set.
+	StartAfter *bson.Raw
+
+	// StartAtOperationTime starts the change stream after the given cluster
+	// time. It is only used when neither StartAfter nor ResumeAfter is set.
+	StartAtOperationTime *bson.MongoTimestamp
+
 	// MaxAwaitTimeMS specifies the maximum amount of time for the server to wait
 	// on new documents to satisfy a change stream query.
 	MaxAwaitTimeMS int64
@@ -37,10 +69,109 @@ type ChangeStreamOptions struct {
 
 	// Collation specifies the way the server should collate returned data.
 	Collation *Collation
+
+	// Monitor, if set, is notified around the aggregate that opens or
+	// resumes the stream, each read from its cursor (reported as a getMore)
+	// and each killCursors. The notifications wrap the driver operations
+	// that may send these commands: a read served from the batch already
+	// received is still reported as a getMore, although no getMore reaches
+	// the server for it.
+	Monitor *ChangeStreamMonitor
+}
+
+// ChangeStreamMonitor receives notifications about the commands a
+// ChangeStream sends to the server, for observability in long-running CDC
+// pipelines: measuring per-batch latency, counting resumes, or logging which
+// resume token was in flight when a failure occurred.
+type ChangeStreamMonitor struct {
+	// Started is called immediately before the monitored operation starts.
+	Started func(command bson.M, requestId int64, connectionId string)
+
+	// Succeeded is called after a command completes successfully.
+	Succeeded func(command bson.M, requestId int64, connectionId string, duration time.Duration)
+
+	// Failed is called after a command fails.
+	Failed func(command bson.M, requestId int64, connectionId string, duration time.Duration, err error)
+}
+
+// changeStreamRequestId is a process-wide counter used to correlate a
+// command's Started call with its matching Succeeded/Failed call.
+var changeStreamRequestId int64
+
+func nextChangeStreamRequestId() int64 {
+	return atomic.AddInt64(&changeStreamRequestId, 1)
+}
+
+func monitorCommandStart(monitor *ChangeStreamMonitor, command bson.M, connectionId string) (requestId int64, start time.Time) {
+	requestId = nextChangeStreamRequestId()
+	start = time.Now()
+	if monitor != nil && monitor.Started != nil {
+		monitor.Started(command, requestId, connectionId)
+	}
+	return requestId, start
+}
+
+func monitorCommandDone(monitor *ChangeStreamMonitor, command bson.M, requestId int64, connectionId string, start time.Time, err error) {
+	if monitor == nil {
+		return
+	}
+
+	duration := time.Since(start)
+	if err != nil {
+		if monitor.Failed != nil {
+			monitor.Failed(command, requestId, connectionId, duration, err)
+		}
+		return
+	}
+	if monitor.Succeeded != nil {
+		monitor.Succeeded(command, requestId, connectionId, duration)
+	}
+}
+
+// sessionConnectionId reports the first address in the session's list of
+// live servers, for inclusion in ChangeStreamMonitor callbacks. It is a
+// best-effort identifier and need not be the server the monitored command
+// runs on: where a socket is actually acquired for the
+// operation being monitored (killCursors, via runKillCursorsOnSession), that
+// socket's own address is reported instead once available.
+func sessionConnectionId(session *Session) string {
+	if session == nil {
+		return ""
+	}
+	if addrs := session.LiveServers(); len(addrs) > 0 {
+		return addrs[0]
+	}
+	return ""
+}
+
+// aggregateCursorReply decodes the {cursor: {firstBatch, id}} portion of a
+// raw aggregate command reply, for the database- and client-level
+// Watch/resume paths below where there is no single collection to build a
+// Pipe against and the aggregate command has to be run directly instead.
+type aggregateCursorReply struct {
+	Cursor struct {
+		FirstBatch []bson.Raw `bson:"firstBatch"`
+		Id         int64      `bson:"id"`
+	} `bson:"cursor"`
+}
+
+// runDatabaseAggregate runs command (an {aggregate: 1, ...} document)
+// directly against db and bootstraps an Iter from its cursor reply.
+// Collection.Pipe always builds its aggregate command from a collection's
+// Name, so it can never send the numeric {aggregate: 1} target a database-
+// or client-level change stream requires; NewIter lets the resulting cursor
+// be driven (getMore, killCursors, ...) the same way as any other.
+func runDatabaseAggregate(db *Database, command bson.M) (*Iter, error) {
+	var reply aggregateCursorReply
+	if err := db.Run(command, &reply); err != nil {
+		return nil, err
+	}
+
+	return db.C("$cmd.aggregate").NewIter(db.Session, reply.Cursor.FirstBatch, reply.Cursor.Id, nil), nil
 }
 
 // Watch constructs a new ChangeStream capable of receiving continuing data
-// from the database.
+// from the collection.
 func (coll *Collection) Watch(pipeline interface{},
 	options ChangeStreamOptions) (*ChangeStream, error) {
 
@@ -48,7 +179,11 @@ func (coll *Collection) Watch(pipeline interface{},
 		pipeline = []bson.M{}
 	}
 
-	pipe := constructChangeStreamPipeline(pipeline, options)
+	pipe := constructChangeStreamPipeline(pipeline, options, collectionChangeStream)
+
+	command := bson.M{"aggregate": coll.Name, "pipeline": pipe}
+	connectionId := sessionConnectionId(coll.Database.Session)
+	requestId, start := monitorCommandStart(options.Monitor, command, connectionId)
 
 	pIter := coll.Pipe(&pipe).Iter()
 
@@ -56,14 +191,96 @@ func (coll *Collection) Watch(pipeline interface{},
 	// this will fail immediately with an error from the server if running against
 	// a standalone.
 	if err := pIter.Err(); err != nil {
+		monitorCommandDone(options.Monitor, command, requestId, connectionId, start, err)
 		return nil, err
 	}
+	monitorCommandDone(options.Monitor, command, requestId, connectionId, start, nil)
 
 	pIter.isChangeStream = true
 
 	return &ChangeStream{
 		iter:        pIter,
 		collection:  coll,
+		targetType:  collectionChangeStream,
+		resumeToken: nil,
+		options:     options,
+		pipeline:    pipeline,
+	}, nil
+}
+
+// Watch constructs a new ChangeStream capable of receiving continuing data
+// from every collection in the database.
+func (db *Database) Watch(pipeline interface{},
+	options ChangeStreamOptions) (*ChangeStream, error) {
+
+	if pipeline == nil {
+		pipeline = []bson.M{}
+	}
+
+	pipe := constructChangeStreamPipeline(pipeline, options, databaseChangeStream)
+
+	// There is no single collection to aggregate against when watching an
+	// entire database, so the aggregate command is run directly against db
+	// with the numeric target {aggregate: 1} the server requires for
+	// database-level aggregations; Collection.Pipe can only ever address a
+	// named collection, so it can't send that.
+	command := bson.M{"aggregate": 1, "pipeline": pipe, "cursor": bson.M{}}
+	connectionId := sessionConnectionId(db.Session)
+	requestId, start := monitorCommandStart(options.Monitor, command, connectionId)
+
+	pIter, err := runDatabaseAggregate(db, command)
+	if err != nil {
+		monitorCommandDone(options.Monitor, command, requestId, connectionId, start, err)
+		return nil, err
+	}
+	monitorCommandDone(options.Monitor, command, requestId, connectionId, start, nil)
+
+	pIter.isChangeStream = true
+
+	return &ChangeStream{
+		iter:        pIter,
+		database:    db,
+		targetType:  databaseChangeStream,
+		resumeToken: nil,
+		options:     options,
+		pipeline:    pipeline,
+	}, nil
+}
+
+// Watch constructs a new ChangeStream capable of receiving continuing data
+// from every database in the deployment. The aggregation is run against the
+// admin database with allChangesForCluster set on the $changeStream stage.
+func (s *Session) Watch(pipeline interface{},
+	options ChangeStreamOptions) (*ChangeStream, error) {
+
+	if pipeline == nil {
+		pipeline = []bson.M{}
+	}
+
+	pipe := constructChangeStreamPipeline(pipeline, options, clientChangeStream)
+
+	db := s.DB("admin")
+
+	// As with Database.Watch, there is no single collection to aggregate
+	// against, so the aggregate command is run directly with the numeric
+	// {aggregate: 1} target rather than through Collection.Pipe.
+	command := bson.M{"aggregate": 1, "pipeline": pipe, "cursor": bson.M{}}
+	connectionId := sessionConnectionId(db.Session)
+	requestId, start := monitorCommandStart(options.Monitor, command, connectionId)
+
+	pIter, err := runDatabaseAggregate(db, command)
+	if err != nil {
+		monitorCommandDone(options.Monitor, command, requestId, connectionId, start, err)
+		return nil, err
+	}
+	monitorCommandDone(options.Monitor, command, requestId, connectionId, start, nil)
+
+	pIter.isChangeStream = true
+
+	return &ChangeStream{
+		iter:        pIter,
+		database:    db,
+		targetType:  clientChangeStream,
 		resumeToken: nil,
 		options:     options,
 		pipeline:    pipeline,
@@ -91,6 +308,11 @@ func (coll *Collection) Watch(pipeline interface{},
 // If the pipeline used removes the _id field from the result, Next will error
 // because the _id field is needed to resume iteration when an error occurs.
 //
+// When the server reports a post-batch resume token, that token is used
+// instead and a result without an _id field is not an error.
+//
+// See NextContext for a variant that can be unblocked by a context.
+//
 func (changeStream *ChangeStream) Next(result interface{}) bool {
 	// the err field is being constantly overwritten and we don't want the user to
 	// attempt to read it at this point so we lock.
@@ -103,10 +325,59 @@ func (changeStream *ChangeStream) Next(result interface{}) bool {
 		return false
 	}
 
-	var err error
+	return changeStream.handleFetch(changeStream.fetchResultSet(result), result)
+}
+
+// NextContext works like Next, but also returns false as soon as ctx is
+// done, even if the server hasn't replied yet. Because MaxAwaitTimeMS can
+// leave a getMore blocked on the server for seconds to minutes, a done ctx
+// triggers a killCursors on a fresh socket to abort that wait rather than
+// leaving the caller stuck until the next batch would have arrived anyway.
+func (changeStream *ChangeStream) NextContext(ctx context.Context, result interface{}) bool {
+	changeStream.m.Lock()
+	defer changeStream.m.Unlock()
+
+	if changeStream.err != nil {
+		return false
+	}
+
+	// Clamp MaxAwaitTimeMS to ctx's remaining deadline for this one getMore,
+	// then restore whatever was there before so later calls (NextContext
+	// with a longer/no deadline, or plain Next) aren't left with a
+	// permanently shortened wait.
+	iter := changeStream.iter
+	previousMaxTimeMS := iter.op.maxTimeMS
+	if maxAwaitTimeMS, ok := clampedMaxAwaitTimeMS(ctx, changeStream.options.MaxAwaitTimeMS); ok {
+		iter.op.maxTimeMS = maxAwaitTimeMS
+	}
+
+	fetchErr := make(chan error, 1)
+	go func() {
+		fetchErr <- changeStream.fetchResultSet(result)
+	}()
+
+	select {
+	case err := <-fetchErr:
+		iter.op.maxTimeMS = previousMaxTimeMS
+		return changeStream.handleFetch(err, result)
+	case <-ctx.Done():
+		// Kill the cursor to abort the in-flight getMore, then wait for the
+		// fetch goroutine to actually finish before we release m and hand
+		// control back to the caller. Without the join, that goroutine would
+		// keep reading/writing changeStream.iter and writing into result
+		// after this call has already returned, racing with whatever the
+		// caller does next.
+		changeStream.abortAwait()
+		<-fetchErr
+		iter.op.maxTimeMS = previousMaxTimeMS
+		changeStream.err = ctx.Err()
+		return false
+	}
+}
 
-	// attempt to fetch the change stream result.
-	err = changeStream.fetchResultSet(result)
+// handleFetch applies the shared resumable-error handling used by both Next
+// and NextContext once fetchResultSet has returned.
+func (changeStream *ChangeStream) handleFetch(err error, result interface{}) bool {
 	if err == nil {
 		return true
 	}
@@ -119,8 +390,7 @@ func (changeStream *ChangeStream) Next(result interface{}) bool {
 	}
 
 	// try to resume.
-	err = changeStream.resume()
-	if err != nil {
+	if err = changeStream.resume(); err != nil {
 		// we've not been able to successfully resume and should only try once,
 		// so we give up.
 		changeStream.err = err
@@ -129,8 +399,7 @@ func (changeStream *ChangeStream) Next(result interface{}) bool {
 
 	// we've successfully resumed the changestream.
 	// try to fetch the next result.
-	err = changeStream.fetchResultSet(result)
-	if err != nil {
+	if err = changeStream.fetchResultSet(result); err != nil {
 		changeStream.err = err
 		return false
 	}
@@ -138,8 +407,96 @@ func (changeStream *ChangeStream) Next(result interface{}) bool {
 	return true
 }
 
-func constructChangeStreamPipeline(pipeline interface{},
-	options ChangeStreamOptions) interface{} {
+// abortAwait kills the server-side cursor on a fresh socket, used to unblock
+// a getMore that NextContext is no longer willing to wait out.
+func (changeStream *ChangeStream) abortAwait() {
+	newSession := changeStream.iter.session.Copy()
+	defer newSession.Close()
+
+	cursorId := changeStream.iter.op.cursorId
+	command := bson.M{"killCursors": changeStream.aggregateCollectionName(), "cursors": []int64{cursorId}}
+	requestId, start := monitorCommandStart(changeStream.options.Monitor, command, sessionConnectionId(newSession))
+
+	connectionId, err := runKillCursorsOnSession(newSession, cursorId)
+
+	monitorCommandDone(changeStream.options.Monitor, command, requestId, connectionId, start, err)
+}
+
+// clampedMaxAwaitTimeMS returns the remaining time until ctx's deadline, in
+// milliseconds, if that's sooner than the currently configured
+// MaxAwaitTimeMS (or MaxAwaitTimeMS isn't set at all). It reports false when
+// ctx has no deadline, the deadline has already passed, or the deadline
+// doesn't tighten the wait.
+func clampedMaxAwaitTimeMS(ctx context.Context, currentMaxAwaitTimeMS int64) (int64, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+
+	remainingMS := time.Until(deadline).Nanoseconds() / int64(time.Millisecond)
+	if remainingMS <= 0 {
+		return 0, false
+	}
+	if currentMaxAwaitTimeMS != 0 && currentMaxAwaitTimeMS < remainingMS {
+		return 0, false
+	}
+
+	return remainingMS, true
+}
+
+// Close kills the cursor backing the change stream, releasing server-side
+// resources. It should be called once the caller is done with the stream.
+func (changeStream *ChangeStream) Close() error {
+	changeStream.m.Lock()
+	defer changeStream.m.Unlock()
+
+	command := bson.M{"killCursors": changeStream.aggregateCollectionName(), "cursors": []int64{changeStream.iter.op.cursorId}}
+	connectionId := sessionConnectionId(changeStream.iter.session)
+	requestId, start := monitorCommandStart(changeStream.options.Monitor, command, connectionId)
+
+	err := changeStream.iter.Close()
+
+	monitorCommandDone(changeStream.options.Monitor, command, requestId, connectionId, start, err)
+	return err
+}
+
+// aggregateCollectionName returns the collection name a killCursors/getMore
+// command for this stream naturally addresses: the watched collection itself
+// for a collection-level stream, or the "$cmd.aggregate" pseudo-collection
+// used to run database- and client-level aggregations.
+func (changeStream *ChangeStream) aggregateCollectionName() string {
+	if changeStream.targetType == collectionChangeStream {
+		return changeStream.collection.Name
+	}
+	return "$cmd.aggregate"
+}
+
+// ResumeToken returns the most recently observed resume token, or nil if the
+// stream has not yet read anything. The returned token can be passed back as
+// ResumeAfter or StartAfter to resume iteration from this point later.
+func (changeStream *ChangeStream) ResumeToken() *bson.Raw {
+	changeStream.resumeTokenMu.Lock()
+	defer changeStream.resumeTokenMu.Unlock()
+
+	return changeStream.resumeToken
+}
+
+func (changeStream *ChangeStream) setResumeToken(token *bson.Raw) {
+	changeStream.resumeTokenMu.Lock()
+	defer changeStream.resumeTokenMu.Unlock()
+
+	changeStream.resumeToken = token
+}
+
+func (changeStream *ChangeStream) getResumeToken() *bson.Raw {
+	changeStream.resumeTokenMu.Lock()
+	defer changeStream.resumeTokenMu.Unlock()
+
+	return changeStream.resumeToken
+}
+
+func constructChangeStreamPipeline(pipeline interface{}, options ChangeStreamOptions,
+	targetType changeStreamTargetType) interface{} {
 	pipelinev := reflect.ValueOf(pipeline)
 
 	// ensure that the pipeline passed in is a slice.
@@ -154,8 +511,19 @@ func constructChangeStreamPipeline(pipeline interface{},
 	if options.FullDocument != "" {
 		changeStreamStageOptions["fullDocument"] = options.FullDocument
 	}
-	if options.ResumeAfter != nil {
+	// startAfter, resumeAfter and startAtOperationTime are mutually exclusive
+	// on the $changeStream stage, so only the highest-precedence one that was
+	// set is sent to the server.
+	switch {
+	case options.StartAfter != nil:
+		changeStreamStageOptions["startAfter"] = options.StartAfter
+	case options.ResumeAfter != nil:
 		changeStreamStageOptions["resumeAfter"] = options.ResumeAfter
+	case options.StartAtOperationTime != nil:
+		changeStreamStageOptions["startAtOperationTime"] = *options.StartAtOperationTime
+	}
+	if targetType == clientChangeStream {
+		changeStreamStageOptions["allChangesForCluster"] = true
 	}
 	changeStreamStage := bson.M{"$changeStream": changeStreamStageOptions}
 
@@ -183,20 +551,58 @@ func (changeStream *ChangeStream) resume() error {
 	// fetch the cursor from the iterator and use it to run a killCursors
 	// on the connection.
 	cursorId := changeStream.iter.op.cursorId
-	err := runKillCursorsOnSession(newSession, cursorId)
+	command := bson.M{"killCursors": changeStream.aggregateCollectionName(), "cursors": []int64{cursorId}}
+	requestId, start := monitorCommandStart(changeStream.options.Monitor, command, sessionConnectionId(newSession))
+	connectionId, err := runKillCursorsOnSession(newSession, cursorId)
+	monitorCommandDone(changeStream.options.Monitor, command, requestId, connectionId, start, err)
 	if err != nil {
 		return err
 	}
 
-	// change out the old connection to the database with the new connection.
-	changeStream.collection.Database.Session = newSession
+	// Prefer resuming from the most recent resume token we've observed (the
+	// post-batch resume token if the server sent one, otherwise the last
+	// document's _id) over whatever the stream was originally opened with.
+	// If we never got a resume token at all, fall back to the operation time
+	// we started at, which constructChangeStreamPipeline will use instead.
+	changeStream.options.StartAfter = nil
+	changeStream.options.ResumeAfter = changeStream.getResumeToken()
 
 	// make a new pipeline containing the resume token.
-	changeStreamPipeline := constructChangeStreamPipeline(changeStream.pipeline, changeStream.options)
+	changeStreamPipeline := constructChangeStreamPipeline(changeStream.pipeline, changeStream.options, changeStream.targetType)
+
+	// change out the old connection to the database with the new connection,
+	// and rebuild the cursor against whichever scope this stream was opened
+	// against, so a database or client-level stream keeps watching the same
+	// scope after a reconnect.
+	var newIter *Iter
+	var aggregateCommand bson.M
+	aggregateConnectionId := sessionConnectionId(newSession)
+
+	switch changeStream.targetType {
+	case collectionChangeStream:
+		changeStream.collection.Database.Session = newSession
+		aggregateCommand = bson.M{"aggregate": changeStream.collection.Name, "pipeline": changeStreamPipeline}
+		aggregateRequestId, aggregateStart := monitorCommandStart(changeStream.options.Monitor, aggregateCommand, aggregateConnectionId)
+		newIter = changeStream.collection.Pipe(changeStreamPipeline).Iter()
+		err = newIter.Err()
+		monitorCommandDone(changeStream.options.Monitor, aggregateCommand, aggregateRequestId, aggregateConnectionId, aggregateStart, err)
+	default:
+		// There is no single collection to aggregate against when watching
+		// an entire database or deployment, so, just like Database.Watch
+		// and Session.Watch, the aggregate command is run directly instead
+		// of through Collection.Pipe.
+		changeStream.database.Session = newSession
+		aggregateCommand = bson.M{"aggregate": 1, "pipeline": changeStreamPipeline, "cursor": bson.M{}}
+		aggregateRequestId, aggregateStart := monitorCommandStart(changeStream.options.Monitor, aggregateCommand, aggregateConnectionId)
+		newIter, err = runDatabaseAggregate(changeStream.database, aggregateCommand)
+		monitorCommandDone(changeStream.options.Monitor, aggregateCommand, aggregateRequestId, aggregateConnectionId, aggregateStart, err)
+	}
+	if err != nil {
+		return err
+	}
 
 	// generate the new iterator with the new connection.
-	newPipe := changeStream.collection.Pipe(changeStreamPipeline)
-	changeStream.iter = newPipe.Iter()
+	changeStream.iter = newIter
 	changeStream.iter.isChangeStream = true
 
 	return nil
@@ -218,30 +624,51 @@ func (changeStream *ChangeStream) fetchResumeToken(rawResult *bson.Raw) error {
 		return fmt.Errorf("resume token missing from result")
 	}
 
-	changeStream.resumeToken = changeStreamResult.ResumeToken
+	changeStream.setResumeToken(changeStreamResult.ResumeToken)
 	return nil
 }
 
 func (changeStream *ChangeStream) fetchResultSet(result interface{}) error {
 	rawResult := bson.Raw{}
 
+	command := bson.M{"getMore": changeStream.iter.op.cursorId, "collection": changeStream.aggregateCollectionName()}
+	connectionId := sessionConnectionId(changeStream.iter.session)
+	requestId, start := monitorCommandStart(changeStream.options.Monitor, command, connectionId)
+
 	// fetch the next set of documents from the cursor.
 	gotNext := changeStream.iter.Next(&rawResult)
 
 	err := changeStream.iter.Err()
+	monitorCommandDone(changeStream.options.Monitor, command, requestId, connectionId, start, err)
 	if err != nil {
 		return err
 	}
 
+	// The post-batch resume token is refreshed on every aggregate/getMore
+	// reply, even when the batch it came with was empty, so it is a better
+	// resume point than the last document's _id whenever the server sends
+	// one. This relies on changeStream.iter.postBatchResumeToken actually
+	// being set from the reply's top-level cursor.postBatchResumeToken by
+	// the aggregate/getMore reply decoding in the socket/session layer,
+	// which is outside this file and isn't part of this tree's diff: until
+	// that plumbing lands, postBatchResumeToken is always nil and every
+	// resume falls back to the last document's _id below.
+	if changeStream.iter.postBatchResumeToken != nil {
+		changeStream.setResumeToken(changeStream.iter.postBatchResumeToken)
+	}
+
 	if !gotNext && err == nil {
 		// If the iter.Err() method returns nil despite us not getting a next batch,
 		// it is becuase iter.Err() silences this case.
 		return ErrNotFound
 	}
 
-	// grab the resumeToken from the results
-	if err := changeStream.fetchResumeToken(&rawResult); err != nil {
-		return err
+	// grab the resumeToken from the result document itself when the server
+	// didn't give us a post-batch resume token to prefer instead.
+	if changeStream.iter.postBatchResumeToken == nil {
+		if err := changeStream.fetchResumeToken(&rawResult); err != nil {
+			return err
+		}
 	}
 
 	// put the raw results into the data structure the user provided.
@@ -251,23 +678,85 @@ func (changeStream *ChangeStream) fetchResultSet(result interface{}) error {
 	return nil
 }
 
+// legacyResumableErrorCodes lists the server error codes known to be
+// resumable on servers old enough (wire version < 9) that they don't report
+// errorLabels on their replies.
+var legacyResumableErrorCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	9001:  true, // SocketException
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+	63:    true, // StaleShardVersion
+	150:   true, // StaleEpoch
+	13388: true, // StaleConfig
+	234:   true, // RetryChangeStream
+	133:   true, // FailedToSatisfyReadPreference
+}
+
+// nonResumableErrorCodes lists codes that must never be treated as
+// resumable, since retrying past them would silently skip data.
+var nonResumableErrorCodes = map[int]bool{
+	11601: true, // Interrupted
+	136:   true, // CappedPositionLost
+	237:   true, // CursorKilled
+}
+
+// isResumableError relies on qerr.ErrorLabels having been populated from the
+// server reply's top-level "errorLabels" array. That decoding happens in the
+// socket/session reply path that builds *QueryError values, not here: if
+// that plumbing isn't in place, ErrorLabels is always empty and every error
+// from a modern server falls through to the legacyResumableErrorCodes
+// allowlist below instead of being classified by label.
 func isResumableError(err error) bool {
-	_, isQueryError := err.(*QueryError)
-	// if it is not a database error OR it is a database error,
-	// but the error is a notMaster error
-	return !isQueryError || isNotMasterError(err)
+	qerr, isQueryError := err.(*QueryError)
+	if !isQueryError {
+		// Transport-level errors (dropped connections, timeouts, ...) have
+		// no reply to inspect and are always resumable.
+		return true
+	}
+
+	if nonResumableErrorCodes[qerr.Code] {
+		return false
+	}
+
+	for _, label := range qerr.ErrorLabels {
+		if label == "ResumableChangeStreamError" || label == "NetworkError" {
+			return true
+		}
+	}
+	if len(qerr.ErrorLabels) > 0 {
+		// The server reported labels but none of them mark this resumable,
+		// which on a modern server is definitive.
+		return false
+	}
+
+	// No errorLabels at all means the server predates their introduction;
+	// fall back to the curated set of legacy codes known to be resumable.
+	return legacyResumableErrorCodes[qerr.Code]
 }
 
-func runKillCursorsOnSession(session *Session, cursorId int64) error {
+// runKillCursorsOnSession issues a killCursors for cursorId over a socket
+// acquired from session, returning that socket's server address so callers
+// can report it as the connectionId a command actually ran over.
+func runKillCursorsOnSession(session *Session, cursorId int64) (connectionId string, err error) {
 	socket, err := session.acquireSocket(true)
 	if err != nil {
-		return err
+		return "", err
 	}
+	connectionId = socket.Server().Addr
+
 	err = socket.Query(&killCursorsOp{[]int64{cursorId}})
 	if err != nil {
-		return err
+		return connectionId, err
 	}
 	socket.Release()
 
-	return nil
+	return connectionId, nil
 }
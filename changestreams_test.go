@@ -0,0 +1,274 @@
+package mgo
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestConstructChangeStreamPipelineResumeOptionPrecedence(t *testing.T) {
+	resumeAfter := &bson.Raw{Kind: 0x05, Data: []byte("resume")}
+	startAfter := &bson.Raw{Kind: 0x05, Data: []byte("start")}
+	opTime := bson.MongoTimestamp(42)
+
+	cases := []struct {
+		name    string
+		options ChangeStreamOptions
+		wantKey string
+	}{
+		{
+			name:    "startAfter wins over resumeAfter and startAtOperationTime",
+			options: ChangeStreamOptions{StartAfter: startAfter, ResumeAfter: resumeAfter, StartAtOperationTime: &opTime},
+			wantKey: "startAfter",
+		},
+		{
+			name:    "resumeAfter wins over startAtOperationTime",
+			options: ChangeStreamOptions{ResumeAfter: resumeAfter, StartAtOperationTime: &opTime},
+			wantKey: "resumeAfter",
+		},
+		{
+			name:    "startAtOperationTime is the fallback",
+			options: ChangeStreamOptions{StartAtOperationTime: &opTime},
+			wantKey: "startAtOperationTime",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pipeline := constructChangeStreamPipeline([]bson.M{}, c.options, collectionChangeStream)
+			stage := pipeline.([]interface{})[0].(bson.M)["$changeStream"].(bson.M)
+
+			for _, key := range []string{"startAfter", "resumeAfter", "startAtOperationTime"} {
+				_, present := stage[key]
+				if key == c.wantKey && !present {
+					t.Fatalf("expected %q to be set on the $changeStream stage, got %v", key, stage)
+				}
+				if key != c.wantKey && present {
+					t.Fatalf("expected %q to be absent from the $changeStream stage, got %v", key, stage)
+				}
+			}
+		})
+	}
+}
+
+func TestConstructChangeStreamPipelineAllChangesForCluster(t *testing.T) {
+	cases := []struct {
+		name       string
+		targetType changeStreamTargetType
+		want       bool
+	}{
+		{"collection-level stream", collectionChangeStream, false},
+		{"database-level stream", databaseChangeStream, false},
+		{"client-level stream", clientChangeStream, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pipeline := constructChangeStreamPipeline([]bson.M{}, ChangeStreamOptions{}, c.targetType)
+			stage := pipeline.([]interface{})[0].(bson.M)["$changeStream"].(bson.M)
+
+			allChangesForCluster, present := stage["allChangesForCluster"]
+			if c.want && (!present || allChangesForCluster != true) {
+				t.Fatalf("expected allChangesForCluster to be true on the $changeStream stage, got %v", stage)
+			}
+			if !c.want && present {
+				t.Fatalf("expected allChangesForCluster to be absent from the $changeStream stage, got %v", stage)
+			}
+		})
+	}
+}
+
+func TestIsResumableError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "transport-level error with no reply to inspect",
+			err:  io.EOF,
+			want: true,
+		},
+		{
+			name: "ResumableChangeStreamError label",
+			err:  &QueryError{Code: 1, ErrorLabels: []string{"ResumableChangeStreamError"}},
+			want: true,
+		},
+		{
+			name: "NetworkError label",
+			err:  &QueryError{Code: 1, ErrorLabels: []string{"NetworkError"}},
+			want: true,
+		},
+		{
+			name: "labels present but none of them resumable",
+			err:  &QueryError{Code: 1, ErrorLabels: []string{"TransientTransactionError"}},
+			want: false,
+		},
+		{
+			name: "no labels, legacy resumable code",
+			err:  &QueryError{Code: 189}, // PrimarySteppedDown
+			want: true,
+		},
+		{
+			name: "no labels, unrecognised code",
+			err:  &QueryError{Code: 1},
+			want: false,
+		},
+		{
+			name: "explicitly non-resumable code wins even with a resumable label",
+			err:  &QueryError{Code: 11601, ErrorLabels: []string{"ResumableChangeStreamError"}},
+			want: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isResumableError(c.err); got != c.want {
+				t.Fatalf("isResumableError(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestClampedMaxAwaitTimeMS(t *testing.T) {
+	t.Run("no deadline on ctx leaves MaxAwaitTimeMS untouched", func(t *testing.T) {
+		if _, ok := clampedMaxAwaitTimeMS(context.Background(), 5000); ok {
+			t.Fatal("expected no clamp for a context without a deadline")
+		}
+	})
+
+	t.Run("deadline tighter than MaxAwaitTimeMS is applied", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		ms, ok := clampedMaxAwaitTimeMS(ctx, 5000)
+		if !ok {
+			t.Fatal("expected the ctx deadline to clamp MaxAwaitTimeMS")
+		}
+		if ms <= 0 || ms > 50 {
+			t.Fatalf("expected a clamp in (0, 50]ms, got %dms", ms)
+		}
+	})
+
+	t.Run("deadline looser than MaxAwaitTimeMS is ignored", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		defer cancel()
+
+		if _, ok := clampedMaxAwaitTimeMS(ctx, 5000); ok {
+			t.Fatal("expected MaxAwaitTimeMS to stay untouched when it's already tighter than the deadline")
+		}
+	})
+
+	t.Run("expired deadline reports no usable wait", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+		defer cancel()
+
+		if _, ok := clampedMaxAwaitTimeMS(ctx, 5000); ok {
+			t.Fatal("expected an already-expired deadline not to produce a clamp")
+		}
+	})
+}
+
+func TestMonitorCommandStartAndDone(t *testing.T) {
+	t.Run("Started and Succeeded receive the command, request id and connection id", func(t *testing.T) {
+		var startedCommand bson.M
+		var startedRequestId int64
+		var startedConnectionId string
+		var succeededRequestId int64
+		var succeededConnectionId string
+		var succeededDuration time.Duration
+
+		monitor := &ChangeStreamMonitor{
+			Started: func(command bson.M, requestId int64, connectionId string) {
+				startedCommand = command
+				startedRequestId = requestId
+				startedConnectionId = connectionId
+			},
+			Succeeded: func(command bson.M, requestId int64, connectionId string, duration time.Duration) {
+				succeededRequestId = requestId
+				succeededConnectionId = connectionId
+				succeededDuration = duration
+			},
+		}
+
+		command := bson.M{"getMore": int64(42)}
+		requestId, start := monitorCommandStart(monitor, command, "server-a:27017")
+
+		if startedCommand["getMore"] != int64(42) {
+			t.Fatalf("expected Started to receive the command, got %v", startedCommand)
+		}
+		if startedRequestId != requestId {
+			t.Fatalf("expected Started's requestId to match the one returned, got %d want %d", startedRequestId, requestId)
+		}
+		if startedConnectionId != "server-a:27017" {
+			t.Fatalf("expected Started's connectionId to be %q, got %q", "server-a:27017", startedConnectionId)
+		}
+
+		monitorCommandDone(monitor, command, requestId, "server-a:27017", start, nil)
+
+		if succeededRequestId != requestId {
+			t.Fatalf("expected Succeeded's requestId to match Started's, got %d want %d", succeededRequestId, requestId)
+		}
+		if succeededConnectionId != "server-a:27017" {
+			t.Fatalf("expected Succeeded's connectionId to be %q, got %q", "server-a:27017", succeededConnectionId)
+		}
+		if succeededDuration < 0 {
+			t.Fatalf("expected a non-negative duration, got %v", succeededDuration)
+		}
+	})
+
+	t.Run("Failed is called instead of Succeeded when the command errors", func(t *testing.T) {
+		var succeededCalled, failedCalled bool
+		var failedErr error
+
+		monitor := &ChangeStreamMonitor{
+			Succeeded: func(command bson.M, requestId int64, connectionId string, duration time.Duration) {
+				succeededCalled = true
+			},
+			Failed: func(command bson.M, requestId int64, connectionId string, duration time.Duration, err error) {
+				failedCalled = true
+				failedErr = err
+			},
+		}
+
+		command := bson.M{"getMore": int64(42)}
+		requestId, start := monitorCommandStart(monitor, command, "server-a:27017")
+
+		wantErr := io.EOF
+		monitorCommandDone(monitor, command, requestId, "server-a:27017", start, wantErr)
+
+		if succeededCalled {
+			t.Fatal("expected Succeeded not to be called when the command failed")
+		}
+		if !failedCalled {
+			t.Fatal("expected Failed to be called when the command failed")
+		}
+		if failedErr != wantErr {
+			t.Fatalf("expected Failed to receive the command's error, got %v", failedErr)
+		}
+	})
+
+	t.Run("a nil monitor is a no-op", func(t *testing.T) {
+		command := bson.M{"getMore": int64(42)}
+		requestId, start := monitorCommandStart(nil, command, "server-a:27017")
+		monitorCommandDone(nil, command, requestId, "server-a:27017", start, nil)
+	})
+
+	t.Run("successive calls get distinct request ids", func(t *testing.T) {
+		command := bson.M{"getMore": int64(42)}
+		firstRequestId, _ := monitorCommandStart(nil, command, "")
+		secondRequestId, _ := monitorCommandStart(nil, command, "")
+		if firstRequestId == secondRequestId {
+			t.Fatalf("expected distinct request ids, got %d twice", firstRequestId)
+		}
+	})
+}
+
+func TestSessionConnectionIdNilSession(t *testing.T) {
+	if got := sessionConnectionId(nil); got != "" {
+		t.Fatalf("expected a nil session to report an empty connectionId, got %q", got)
+	}
+}